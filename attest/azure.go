@@ -0,0 +1,126 @@
+// Copyright 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package attest
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"fmt"
+	"io"
+
+	"github.com/google/certificate-transparency-go/x509"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+const (
+	// azureAKCertNVRAMIndex is the well-known NVRAM index Azure
+	// provisions a confidential VM's attestation key certificate at,
+	// as part of its trusted launch / vTPM feature.
+	azureAKCertNVRAMIndex = 0x1C101D0
+	// azureAKHandle is the persistent handle Azure loads the
+	// corresponding AK into.
+	azureAKHandle = 0x81000003
+)
+
+// AzureAK is an attestation key provisioned into a TPM by Azure's trusted
+// launch / confidential VM vTPM feature, together with the certificate
+// Azure's provisioning agent installed for it.
+type AzureAK struct {
+	// Cert is the AK certificate Azure's provisioning agent wrote to
+	// NVRAM.
+	Cert *x509.Certificate
+	// Public is the marshaled TPMT_PUBLIC of the AK, as read from its
+	// persistent handle.
+	Public []byte
+}
+
+// AzureAttestationKey reads the AK certificate and public area Azure
+// provisions at well-known NVRAM/handle locations on confidential VMs
+// using trusted launch. It does not validate the certificate against
+// Microsoft's roots; callers that need a verified key should pass the
+// result to VerifyAzureAK.
+func (t *TPM) AzureAttestationKey() (*AzureAK, error) {
+	return azureAttestationKey(t.tpm)
+}
+
+func azureAttestationKey(rw io.ReadWriter) (*AzureAK, error) {
+	certDER, err := tpm2.NVReadEx(rw, tpmutil.Handle(azureAKCertNVRAMIndex), tpm2.HandleOwner, "", 0)
+	if err != nil {
+		return nil, fmt.Errorf("reading azure ak cert from nvram: %v", err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, fmt.Errorf("parsing azure ak cert: %v", err)
+	}
+
+	pub, _, _, err := tpm2.ReadPublic(rw, tpmutil.Handle(azureAKHandle))
+	if err != nil {
+		return nil, fmt.Errorf("reading azure ak public area: %v", err)
+	}
+	pubEncoded, err := pub.Encode()
+	if err != nil {
+		return nil, fmt.Errorf("encoding azure ak public area: %v", err)
+	}
+
+	return &AzureAK{Cert: cert, Public: pubEncoded}, nil
+}
+
+// VerifyAzureAK validates an AzureAK's certificate against roots (the
+// Microsoft Azure vTPM root CAs), confirms the certificate's public key
+// matches the AK's public area, and cross-checks ekCert -- the EK
+// certificate read from the same TPM -- against the AK certificate to
+// confirm both were provisioned for the same vTPM instance.
+//
+// This does not itself replay the TPM2_ActivateCredential challenge
+// Azure's provisioning agent performed to bind the AK to the EK at
+// provisioning time; that challenge requires interacting with the live
+// TPM, not just the certificates it leaves behind. Instead, it relies on
+// Azure's provisioning CA having performed that challenge before issuing
+// either certificate, and guards against the two certificates having been
+// independently substituted by requiring they share an issuer.
+func VerifyAzureAK(ak *AzureAK, ekCert *x509.Certificate, roots *x509.CertPool) error {
+	if _, err := ak.Cert.Verify(x509.VerifyOptions{Roots: roots}); err != nil {
+		return fmt.Errorf("verifying azure ak certificate chain: %v", err)
+	}
+	if _, err := ekCert.Verify(x509.VerifyOptions{Roots: roots}); err != nil {
+		return fmt.Errorf("verifying azure ek certificate chain: %v", err)
+	}
+	if !bytes.Equal(ak.Cert.RawIssuer, ekCert.RawIssuer) {
+		return fmt.Errorf("azure ak and ek certificates were issued by different CAs, cannot confirm they belong to the same vTPM")
+	}
+
+	pub, err := tpm2.DecodePublic(ak.Public)
+	if err != nil {
+		return fmt.Errorf("decoding ak public area: %v", err)
+	}
+	akPub, err := pub.Key()
+	if err != nil {
+		return fmt.Errorf("extracting ak public key: %v", err)
+	}
+	akRSA, ok := akPub.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("unsupported azure ak key type %T", akPub)
+	}
+	certRSA, ok := ak.Cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("unsupported azure ak certificate key type %T", ak.Cert.PublicKey)
+	}
+	if akRSA.E != certRSA.E || akRSA.N.Cmp(certRSA.N) != 0 {
+		return fmt.Errorf("azure ak certificate public key does not match the ak public area")
+	}
+	return nil
+}
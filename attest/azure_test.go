@@ -0,0 +1,162 @@
+// Copyright 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package attest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	stdx509 "crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/google/certificate-transparency-go/x509"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// issueTestCert signs a leaf certificate for pub using caKey/caCert, then
+// reparses it with the ctfe x509 package this package uses everywhere
+// else.
+func issueTestCert(t *testing.T, serial int64, pub *rsa.PublicKey, caCert *stdx509.Certificate, caKey *rsa.PrivateKey) *x509.Certificate {
+	t.Helper()
+	tmpl := &stdx509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "test-leaf"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := stdx509.CreateCertificate(rand.Reader, tmpl, caCert, pub, caKey)
+	if err != nil {
+		t.Fatalf("creating test certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing test certificate: %v", err)
+	}
+	return cert
+}
+
+// testAzurePKI builds a self-signed CA and a CertPool containing it, for
+// use as the roots argument to VerifyAzureAK.
+func testAzurePKI(t *testing.T) (*stdx509.Certificate, *rsa.PrivateKey, *x509.CertPool) {
+	t.Helper()
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating CA key: %v", err)
+	}
+	caTmpl := &stdx509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-azure-vtpm-root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              stdx509.KeyUsageCertSign,
+	}
+	caDER, err := stdx509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("creating CA certificate: %v", err)
+	}
+	stdCACert, err := stdx509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("parsing CA certificate: %v", err)
+	}
+	ctfeCACert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("parsing CA certificate (ctfe): %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ctfeCACert)
+	return stdCACert, caKey, roots
+}
+
+func encodeTestRSAPublicArea(t *testing.T, pub *rsa.PublicKey) []byte {
+	t.Helper()
+	public := tpm2.Public{
+		Type:       tpm2.AlgRSA,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagSignerDefault,
+		RSAParameters: &tpm2.RSAParams{
+			Sign: &tpm2.SigScheme{
+				Alg:  tpm2.AlgRSASSA,
+				Hash: tpm2.AlgSHA256,
+			},
+			KeyBits:    uint16(pub.N.BitLen()),
+			ModulusRaw: pub.N.Bytes(),
+		},
+	}
+	encoded, err := public.Encode()
+	if err != nil {
+		t.Fatalf("encoding test public area: %v", err)
+	}
+	return encoded
+}
+
+func TestVerifyAzureAKPublicKeyMismatch(t *testing.T) {
+	caCert, caKey, roots := testAzurePKI(t)
+
+	akKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating ak key: %v", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating mismatched key: %v", err)
+	}
+	ekKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating ek key: %v", err)
+	}
+
+	akCert := issueTestCert(t, 2, &akKey.PublicKey, caCert, caKey)
+	ekCert := issueTestCert(t, 3, &ekKey.PublicKey, caCert, caKey)
+
+	ak := &AzureAK{
+		Cert:   akCert,
+		Public: encodeTestRSAPublicArea(t, &otherKey.PublicKey), // does not match akCert's key
+	}
+
+	if err := VerifyAzureAK(ak, ekCert, roots); err == nil {
+		t.Errorf("VerifyAzureAK() succeeded with a mismatched public area, want error")
+	}
+}
+
+func TestVerifyAzureAKMatchingPublicKey(t *testing.T) {
+	caCert, caKey, roots := testAzurePKI(t)
+
+	akKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating ak key: %v", err)
+	}
+	ekKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating ek key: %v", err)
+	}
+
+	akCert := issueTestCert(t, 2, &akKey.PublicKey, caCert, caKey)
+	ekCert := issueTestCert(t, 3, &ekKey.PublicKey, caCert, caKey)
+
+	ak := &AzureAK{
+		Cert:   akCert,
+		Public: encodeTestRSAPublicArea(t, &akKey.PublicKey),
+	}
+
+	if err := VerifyAzureAK(ak, ekCert, roots); err != nil {
+		t.Errorf("VerifyAzureAK() failed for a consistent ak/ek pair: %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package attest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/google/certificate-transparency-go/x509"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// EKCertResolver locates and returns an EK certificate for a TPM that does
+// not carry one in its standard NVRAM index (nvramCertIndex). Resolvers
+// are registered per-manufacturer with RegisterEKCertResolver and
+// consulted by ResolveEKCert when the standard index is empty.
+type EKCertResolver interface {
+	// ResolveEKCert returns the EK certificate for ekPub, the EK public
+	// key read from the TPM (either *rsa.PublicKey or *ecdsa.PublicKey).
+	// Implementations may read further NVRAM indices, make network
+	// calls, or both.
+	ResolveEKCert(tpm io.ReadWriter, ekPub crypto.PublicKey) (*x509.Certificate, error)
+}
+
+var ekCertResolvers = map[TCGVendorID]EKCertResolver{}
+
+// RegisterEKCertResolver registers resolver as the EK certificate resolver
+// for TPMs whose manufacturer ID (as read from TPM_PT_MANUFACTURER) is
+// vendor. Registering a resolver for a vendor that already has one
+// replaces it. It is not safe to call concurrently with ResolveEKCert.
+func RegisterEKCertResolver(vendor TCGVendorID, resolver EKCertResolver) {
+	ekCertResolvers[vendor] = resolver
+}
+
+func init() {
+	// Intel is the only manufacturer with a documented, vendor-specific
+	// EK certificate resolution mechanism (its public EK cert service).
+	// The other manufacturers TPM2_GetCapability(TPM_PT_MANUFACTURER) can
+	// report are registered explicitly against the generic NVRAM sweep,
+	// since ResolveEKCert falls back to it anyway for any vendor without
+	// its own resolver: registering them here is just documentation that
+	// these vendors were considered and have no special-cased mechanism,
+	// rather than an oversight.
+	RegisterEKCertResolver(vendorIDIntel, intelEKCertResolver{})
+	RegisterEKCertResolver(vendorIDInfineon, genericNVRAMSweepResolver{})
+	RegisterEKCertResolver(vendorIDNuvoton, genericNVRAMSweepResolver{})
+	RegisterEKCertResolver(vendorIDSTMicro, genericNVRAMSweepResolver{})
+	RegisterEKCertResolver(vendorIDAMD, genericNVRAMSweepResolver{})
+}
+
+// Vendor IDs as reported via TPM_PT_MANUFACTURER: up to 4 ASCII
+// characters, packed big-endian into the uint32 TCGVendorID.
+var (
+	vendorIDIntel    = packVendorID("INTC")
+	vendorIDInfineon = packVendorID("IFX")
+	vendorIDNuvoton  = packVendorID("NTC")
+	vendorIDSTMicro  = packVendorID("STM ")
+	vendorIDAMD      = packVendorID("AMD")
+)
+
+// packVendorID packs up to 4 ASCII characters big-endian into a
+// TCGVendorID, as TPM_PT_MANUFACTURER reports them: the first character
+// in the most significant byte, and names shorter than 4 characters
+// padded with NUL bytes.
+func packVendorID(ascii string) TCGVendorID {
+	var v uint32
+	for i := 0; i < 4; i++ {
+		var c byte
+		if i < len(ascii) {
+			c = ascii[i]
+		}
+		v = v<<8 | uint32(c)
+	}
+	return TCGVendorID(v)
+}
+
+// ResolveEKCert looks up an EK certificate for ekPub using the resolver
+// registered for manufacturer, falling back to a generic NVRAM sweep of
+// the indices the TCG PC Client Platform spec reserves for EK
+// certificates if no vendor-specific resolver is registered, or it fails.
+// Callers that already have an EK public key in hand (e.g. from a
+// previous NV read that came back empty) use this directly in place of
+// re-deriving the fallback logic themselves.
+func ResolveEKCert(tpm io.ReadWriter, manufacturer TCGVendorID, ekPub crypto.PublicKey) (*x509.Certificate, error) {
+	if resolver, ok := ekCertResolvers[manufacturer]; ok {
+		cert, err := resolver.ResolveEKCert(tpm, ekPub)
+		if err == nil {
+			return cert, nil
+		}
+	}
+	return genericNVRAMSweepResolver{}.ResolveEKCert(tpm, ekPub)
+}
+
+// intelEKCertResolver fetches the EK certificate from Intel's public EK
+// certificate service, keyed by a hash of the EK public key. This is the
+// resolver Intel fTPMs and discrete TPMs rely on in lieu of NVRAM
+// provisioning. Both RSA and ECC EKs are supported, since Intel's service
+// keys each differently.
+type intelEKCertResolver struct{}
+
+func (intelEKCertResolver) ResolveEKCert(tpm io.ReadWriter, ekPub crypto.PublicKey) (*x509.Certificate, error) {
+	var url string
+	switch pub := ekPub.(type) {
+	case *rsa.PublicKey:
+		url = intelEKURL(pub)
+	case *ecdsa.PublicKey:
+		url = intelEKURLECC(pub)
+	default:
+		return nil, fmt.Errorf("unsupported EK public key type %T", ekPub)
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("fetching EK cert from %s: %v", intelEKCertServiceURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching EK cert from %s: status %s", intelEKCertServiceURL, resp.Status)
+	}
+	der, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading EK cert response: %v", err)
+	}
+	return ParseEKCertificate(der)
+}
+
+// nvramIndexEKCertResolver reads the EK certificate from a single,
+// vendor-specific NVRAM index.
+type nvramIndexEKCertResolver struct {
+	nvramIndex uint32
+}
+
+func (r nvramIndexEKCertResolver) ResolveEKCert(tpm io.ReadWriter, ekPub crypto.PublicKey) (*x509.Certificate, error) {
+	ekCert, err := tpm2.NVReadEx(tpm, tpmutil.Handle(r.nvramIndex), tpm2.HandleOwner, "", 0)
+	if err != nil {
+		return nil, fmt.Errorf("reading EK cert from NVRAM index %#x: %v", r.nvramIndex, err)
+	}
+	return ParseEKCertificate(ekCert)
+}
+
+// genericNVRAMSweepIndices are the NVRAM indices the TCG PC Client
+// Platform Firmware Profile reserves for EK certificates, starting with
+// the primary nvramCertIndex this package already reads by default.
+var genericNVRAMSweepIndices = []uint32{
+	0x1c00002, // RSA 2048 EK certificate (default index)
+	0x1c0000a, // ECC NIST P256 EK certificate
+	0x1c00003, // RSA 2048 EK certificate, platform manufacturer-specific
+	0x1c00012, // RSA 2048 EK certificate, alternate
+}
+
+// genericNVRAMSweepResolver tries each of genericNVRAMSweepIndices in
+// turn, returning the first that holds a certificate which parses
+// successfully.
+type genericNVRAMSweepResolver struct{}
+
+func (genericNVRAMSweepResolver) ResolveEKCert(tpm io.ReadWriter, ekPub crypto.PublicKey) (*x509.Certificate, error) {
+	var lastErr error
+	for _, idx := range genericNVRAMSweepIndices {
+		der, err := tpm2.NVReadEx(tpm, tpmutil.Handle(idx), tpm2.HandleOwner, "", 0)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		cert, err := ParseEKCertificate(der)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return cert, nil
+	}
+	return nil, fmt.Errorf("no EK certificate found by NVRAM sweep, last error: %v", lastErr)
+}
@@ -0,0 +1,140 @@
+// Copyright 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package attest
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/google/certificate-transparency-go/x509"
+)
+
+type fakeEKCertResolver struct {
+	called *bool
+	cert   *x509.Certificate
+	err    error
+}
+
+func (r fakeEKCertResolver) ResolveEKCert(_ io.ReadWriter, _ crypto.PublicKey) (*x509.Certificate, error) {
+	*r.called = true
+	return r.cert, r.err
+}
+
+// erroringTPM is an io.ReadWriter that fails every write, standing in for
+// a TPM that isn't actually present, so tests can drive ResolveEKCert's
+// fallback NVRAM sweep without a real device.
+type erroringTPM struct{}
+
+func (erroringTPM) Read(p []byte) (int, error)  { return 0, io.EOF }
+func (erroringTPM) Write(p []byte) (int, error) { return 0, fmt.Errorf("no tpm available") }
+
+func TestRegisterEKCertResolverOverridesBuiltin(t *testing.T) {
+	prev := ekCertResolvers[vendorIDIntel]
+	defer func() { ekCertResolvers[vendorIDIntel] = prev }()
+
+	var called bool
+	RegisterEKCertResolver(vendorIDIntel, fakeEKCertResolver{called: &called})
+
+	resolver, ok := ekCertResolvers[vendorIDIntel]
+	if !ok {
+		t.Fatalf("resolver not registered for vendorIDIntel")
+	}
+	if _, ok := resolver.(fakeEKCertResolver); !ok {
+		t.Fatalf("registered resolver is %T, want fakeEKCertResolver", resolver)
+	}
+}
+
+func TestResolveEKCertUsesRegisteredResolver(t *testing.T) {
+	const vendorIDTest = TCGVendorID(0x54455354) // "TEST"
+	prev, hadPrev := ekCertResolvers[vendorIDTest]
+	defer func() {
+		if hadPrev {
+			ekCertResolvers[vendorIDTest] = prev
+		} else {
+			delete(ekCertResolvers, vendorIDTest)
+		}
+	}()
+
+	want := &x509.Certificate{}
+	var called bool
+	RegisterEKCertResolver(vendorIDTest, fakeEKCertResolver{called: &called, cert: want})
+
+	got, err := ResolveEKCert(erroringTPM{}, vendorIDTest, nil)
+	if err != nil {
+		t.Fatalf("ResolveEKCert() failed: %v", err)
+	}
+	if !called {
+		t.Errorf("ResolveEKCert() did not call the registered resolver")
+	}
+	if got != want {
+		t.Errorf("ResolveEKCert() = %v, want the registered resolver's certificate", got)
+	}
+}
+
+func TestResolveEKCertFallsBackToGenericSweepWhenUnregistered(t *testing.T) {
+	const vendorIDUnknown = TCGVendorID(0x554e4b4e) // "UNKN", not a registered vendor
+	if _, ok := ekCertResolvers[vendorIDUnknown]; ok {
+		t.Fatalf("test vendor unexpectedly has a registered resolver")
+	}
+
+	_, err := ResolveEKCert(erroringTPM{}, vendorIDUnknown, nil)
+	if err == nil {
+		t.Fatalf("ResolveEKCert() succeeded against a TPM with no EK certs, want error")
+	}
+	if !strings.Contains(err.Error(), "NVRAM sweep") {
+		t.Errorf("ResolveEKCert() error = %q, want it to come from the generic NVRAM sweep fallback", err)
+	}
+}
+
+func TestResolveEKCertFallsBackToGenericSweepWhenResolverFails(t *testing.T) {
+	const vendorIDTest = TCGVendorID(0x54455354) // "TEST"
+	prev, hadPrev := ekCertResolvers[vendorIDTest]
+	defer func() {
+		if hadPrev {
+			ekCertResolvers[vendorIDTest] = prev
+		} else {
+			delete(ekCertResolvers, vendorIDTest)
+		}
+	}()
+
+	var called bool
+	RegisterEKCertResolver(vendorIDTest, fakeEKCertResolver{called: &called, err: fmt.Errorf("vendor service unavailable")})
+
+	_, err := ResolveEKCert(erroringTPM{}, vendorIDTest, nil)
+	if err == nil {
+		t.Fatalf("ResolveEKCert() succeeded against a TPM with no EK certs, want error")
+	}
+	if !called {
+		t.Errorf("ResolveEKCert() did not call the registered resolver before falling back")
+	}
+	if !strings.Contains(err.Error(), "NVRAM sweep") {
+		t.Errorf("ResolveEKCert() error = %q, want it to come from the generic NVRAM sweep fallback", err)
+	}
+}
+
+func TestGenericNVRAMSweepIndicesIncludesDefault(t *testing.T) {
+	var found bool
+	for _, idx := range genericNVRAMSweepIndices {
+		if idx == nvramCertIndex {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("genericNVRAMSweepIndices does not include the default nvramCertIndex %#x", uint32(nvramCertIndex))
+	}
+}
@@ -0,0 +1,539 @@
+// Copyright 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package attest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/google/certificate-transparency-go/x509"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// AttestationReport bundles everything a relying party needs to make a
+// single remote-attestation trust decision about a TPM 2.0 platform: a
+// quote over the SHA-256 PCR bank, the live values of both the SHA-1 and
+// SHA-256 PCR banks, the event logs the PCRs were extended from, and the
+// EK certificate identifying the TPM.
+type AttestationReport struct {
+	// Quote is the AIK-signed quote over the SHA-256 PCR bank.
+	Quote *Quote
+	// PCRsSHA256 and PCRsSHA1 are the live PCR values read directly from
+	// the TPM, indexed by PCR number.
+	PCRsSHA256 map[uint32][]byte
+	PCRsSHA1   map[uint32][]byte
+	// EventLog is the raw TCG event log, as read from
+	// /sys/kernel/security/tpm0/binary_bios_measurements.
+	EventLog []byte
+	// IMALog is the raw IMA event log, as read from
+	// /sys/kernel/security/ima/ascii_runtime_measurements.
+	IMALog []byte
+	// EKCert is the EK certificate of the TPM the report was generated
+	// on, if one could be resolved.
+	EKCert *x509.Certificate
+}
+
+// GenerateAttestationReport quotes the SHA-256 PCR bank over aikHandle,
+// reads both PCR banks, and packages them together with the supplied
+// event logs and EK certificate into an AttestationReport ready to send
+// to a verifier.
+func GenerateAttestationReport(tpm io.ReadWriter, aikHandle tpmutil.Handle, nonce []byte, ekCert *x509.Certificate, eventLog, imaLog []byte) (*AttestationReport, error) {
+	quote, err := quote20(tpm, aikHandle, tpm2.AlgSHA256, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("quoting PCRs: %v", err)
+	}
+	sha256PCRs, err := readAllPCRs20(tpm, tpm2.AlgSHA256)
+	if err != nil {
+		return nil, fmt.Errorf("reading SHA-256 PCR bank: %v", err)
+	}
+	sha1PCRs, err := readAllPCRs20(tpm, tpm2.AlgSHA1)
+	if err != nil {
+		return nil, fmt.Errorf("reading SHA-1 PCR bank: %v", err)
+	}
+
+	return &AttestationReport{
+		Quote:      quote,
+		PCRsSHA256: sha256PCRs,
+		PCRsSHA1:   sha1PCRs,
+		EventLog:   eventLog,
+		IMALog:     imaLog,
+		EKCert:     ekCert,
+	}, nil
+}
+
+// EventLogEvent is a single measurement from a TCG event log. Digest is
+// always populated; DigestSHA256 is additionally populated when the
+// event came from the crypto-agile TPM2 event log format (which records
+// a digest per active PCR bank) and that format included a SHA-256
+// digest for this event.
+type EventLogEvent struct {
+	PCRIndex     uint32
+	EventType    uint32
+	Digest       [20]byte
+	DigestSHA256 []byte
+	Data         []byte
+}
+
+// evNoActionType is the TCG_PCClientPCREventStructure EventType that, as
+// the first event in a log, signals a "Spec ID Event" carrying the log
+// format version: its presence with the signature below means every
+// following event uses the crypto-agile TCG_PCR_EVENT2 structure instead
+// of the legacy, SHA-1-only structure.
+const evNoActionType = 0x00000003
+
+var specIDEventSignature = []byte("Spec ID Event03\x00")
+
+// hashAlgDigestSize maps the TCG_ALG hash algorithm identifiers used in
+// crypto-agile event log digests to their output size in bytes.
+var hashAlgDigestSize = map[uint16]int{
+	0x0004: sha1.Size,   // TPM_ALG_SHA1
+	0x000B: sha256.Size, // TPM_ALG_SHA256
+	0x000C: 48,          // TPM_ALG_SHA384
+}
+
+// ParseEventLog parses a TCG PC Client event log, as found at
+// /sys/kernel/security/tpm0/binary_bios_measurements on Linux. The first
+// event is always the legacy TCG_PCClientPCREventStructure; if it is a
+// Spec ID Event signaling the crypto-agile log format, the remaining
+// events are parsed as TCG_PCR_EVENT2 structures instead, which is how
+// firmware that extends PCRs in both the SHA-1 and SHA-256 banks records
+// them.
+func ParseEventLog(log []byte) ([]EventLogEvent, error) {
+	r := bytes.NewReader(log)
+
+	first, err := parseLegacyEvent(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading first event: %v", err)
+	}
+	events := []EventLogEvent{first}
+
+	cryptoAgile := first.EventType == evNoActionType && bytes.HasPrefix(first.Data, specIDEventSignature)
+	for r.Len() > 0 {
+		var e EventLogEvent
+		if cryptoAgile {
+			e, err = parseCryptoAgileEvent(r)
+		} else {
+			e, err = parseLegacyEvent(r)
+		}
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// parseLegacyEvent parses a single TCG_PCClientPCREventStructure: a PCR
+// index, event type, SHA-1 digest, and length-prefixed event data.
+func parseLegacyEvent(r *bytes.Reader) (EventLogEvent, error) {
+	var e EventLogEvent
+	if err := binary.Read(r, binary.LittleEndian, &e.PCRIndex); err != nil {
+		return e, fmt.Errorf("reading pcrIndex: %v", err)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &e.EventType); err != nil {
+		return e, fmt.Errorf("reading eventType: %v", err)
+	}
+	if _, err := io.ReadFull(r, e.Digest[:]); err != nil {
+		return e, fmt.Errorf("reading digest: %v", err)
+	}
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return e, fmt.Errorf("reading event size: %v", err)
+	}
+	e.Data = make([]byte, size)
+	if _, err := io.ReadFull(r, e.Data); err != nil {
+		return e, fmt.Errorf("reading event data: %v", err)
+	}
+	return e, nil
+}
+
+// parseCryptoAgileEvent parses a single TCG_PCR_EVENT2 structure: a PCR
+// index and event type, a count-prefixed list of (algorithm, digest)
+// pairs (one per active PCR bank), and length-prefixed event data.
+func parseCryptoAgileEvent(r *bytes.Reader) (EventLogEvent, error) {
+	var e EventLogEvent
+	if err := binary.Read(r, binary.LittleEndian, &e.PCRIndex); err != nil {
+		return e, fmt.Errorf("reading pcrIndex: %v", err)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &e.EventType); err != nil {
+		return e, fmt.Errorf("reading eventType: %v", err)
+	}
+
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return e, fmt.Errorf("reading digest count: %v", err)
+	}
+	for i := uint32(0); i < count; i++ {
+		var alg uint16
+		if err := binary.Read(r, binary.LittleEndian, &alg); err != nil {
+			return e, fmt.Errorf("reading digest algorithm: %v", err)
+		}
+		size, ok := hashAlgDigestSize[alg]
+		if !ok {
+			return e, fmt.Errorf("unsupported digest algorithm %#x", alg)
+		}
+		digest := make([]byte, size)
+		if _, err := io.ReadFull(r, digest); err != nil {
+			return e, fmt.Errorf("reading digest: %v", err)
+		}
+		switch alg {
+		case 0x0004: // TPM_ALG_SHA1
+			copy(e.Digest[:], digest)
+		case 0x000B: // TPM_ALG_SHA256
+			e.DigestSHA256 = digest
+		}
+	}
+
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return e, fmt.Errorf("reading event size: %v", err)
+	}
+	e.Data = make([]byte, size)
+	if _, err := io.ReadFull(r, e.Data); err != nil {
+		return e, fmt.Errorf("reading event data: %v", err)
+	}
+	return e, nil
+}
+
+// ReplaySHA1PCRs reconstructs the SHA-1 PCR bank implied by events,
+// starting every PCR at its power-on value of 20 zero bytes.
+func ReplaySHA1PCRs(events []EventLogEvent) map[uint32][]byte {
+	pcrs := map[uint32][]byte{}
+	for _, e := range events {
+		pcr, ok := pcrs[e.PCRIndex]
+		if !ok {
+			pcr = make([]byte, sha1.Size)
+		}
+		h := sha1.New()
+		h.Write(pcr)
+		h.Write(e.Digest[:])
+		pcrs[e.PCRIndex] = h.Sum(nil)
+	}
+	return pcrs
+}
+
+// ReplaySHA256PCRs reconstructs the SHA-256 PCR bank implied by events,
+// starting every PCR at its power-on value of 32 zero bytes. Events from
+// a legacy (SHA-1-only) log carry no SHA-256 digest and are skipped, so
+// this returns an empty map unless the log is the crypto-agile format.
+func ReplaySHA256PCRs(events []EventLogEvent) map[uint32][]byte {
+	pcrs := map[uint32][]byte{}
+	for _, e := range events {
+		if e.DigestSHA256 == nil {
+			continue
+		}
+		pcr, ok := pcrs[e.PCRIndex]
+		if !ok {
+			pcr = make([]byte, sha256.Size)
+		}
+		h := sha256.New()
+		h.Write(pcr)
+		h.Write(e.DigestSHA256)
+		pcrs[e.PCRIndex] = h.Sum(nil)
+	}
+	return pcrs
+}
+
+// ReplayIMALog reconstructs the IMA PCR (conventionally PCR 10) from an
+// ascii_runtime_measurements log, whose lines are of the form
+// "<pcr> <template-hash> <template-name> <filedata-hash> <path>".
+func ReplayIMALog(log []byte) (map[uint32][]byte, error) {
+	pcrs := map[uint32][]byte{}
+	lines := bytes.Split(bytes.TrimRight(log, "\n"), []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		fields := bytes.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("ima log line %d: expected at least 2 fields, got %d", i, len(fields))
+		}
+		var pcrIndex uint32
+		if _, err := fmt.Sscanf(string(fields[0]), "%d", &pcrIndex); err != nil {
+			return nil, fmt.Errorf("ima log line %d: parsing pcr index: %v", i, err)
+		}
+		templateHash := make([]byte, hex.DecodedLen(len(fields[1])))
+		if _, err := hex.Decode(templateHash, fields[1]); err != nil {
+			return nil, fmt.Errorf("ima log line %d: decoding template-hash: %v", i, err)
+		}
+
+		pcr, ok := pcrs[pcrIndex]
+		if !ok {
+			pcr = make([]byte, sha1.Size)
+		}
+		h := sha1.New()
+		h.Write(pcr)
+		h.Write(templateHash)
+		pcrs[pcrIndex] = h.Sum(nil)
+	}
+	return pcrs, nil
+}
+
+// Policy describes the expected state of an attested platform: the PCR
+// values it should report, and event log entries that must be present.
+type Policy struct {
+	// PCRs maps a PCR index to its expected SHA-256 value. Every entry
+	// must match the quoted PCR bank.
+	PCRs map[uint32][]byte
+	// EventLogEntries, if non-nil, must each appear (as a substring
+	// match against the event's Data) somewhere in the platform's event
+	// log, e.g. to confirm Secure Boot variables, the MokList, or a
+	// kernel command line were measured with an expected value.
+	EventLogEntries [][]byte
+	// IMAEntries, if non-nil, must each appear (as a substring match)
+	// somewhere in the platform's IMA log, e.g. to confirm specific
+	// file hashes were measured.
+	IMAEntries [][]byte
+}
+
+// Verify checks that report satisfies policy: report.Quote is a valid
+// TPM2_Quote over nonce signed by the AIK identified by aikPublicArea
+// (the marshaled TPMT_PUBLIC of the AIK the report claims to come from),
+// the quoted PCRs match the live PCR reads, the event log replays to those
+// same PCRs, and the policy's PCR values and expected log entries are all
+// present. The IMA log is only searched for policy.IMAEntries; it is not
+// replayed against any PCR. report.EKCert is not examined.
+//
+// Everything Verify checks beyond the quote signature itself -- the live
+// PCR reads and the event logs -- is otherwise attacker-controlled data
+// carried alongside the report; the signature check is what ties that
+// data to a TPM that holds aikPublicArea's private key, and must pass
+// before any of it is trusted.
+func Verify(report *AttestationReport, aikPublicArea []byte, policy Policy, nonce []byte) error {
+	aikPub, err := parseAIKPublicKey(aikPublicArea)
+	if err != nil {
+		return fmt.Errorf("parsing aik public area: %v", err)
+	}
+	if err := verifyQuoteSignature(aikPub, report.Quote.Quote, report.Quote.Signature); err != nil {
+		return fmt.Errorf("verifying quote signature: %v", err)
+	}
+
+	extraData, pcrDigest, err := parseTPMSAttestQuote(report.Quote.Quote)
+	if err != nil {
+		return fmt.Errorf("parsing quote: %v", err)
+	}
+	if !bytes.Equal(extraData, nonce) {
+		return fmt.Errorf("quote nonce does not match")
+	}
+
+	if !bytes.Equal(pcrDigest, sha256DigestPCRs(report.PCRsSHA256)) {
+		return fmt.Errorf("quoted pcrDigest does not match the report's PCR values")
+	}
+
+	for idx, want := range policy.PCRs {
+		got, ok := report.PCRsSHA256[idx]
+		if !ok {
+			return fmt.Errorf("policy requires PCR %d, which the report does not contain", idx)
+		}
+		if !bytes.Equal(got, want) {
+			return fmt.Errorf("PCR %d is %x, policy requires %x", idx, got, want)
+		}
+	}
+
+	if len(report.EventLog) > 0 || len(policy.EventLogEntries) > 0 {
+		events, err := ParseEventLog(report.EventLog)
+		if err != nil {
+			return fmt.Errorf("parsing event log: %v", err)
+		}
+		replayed := ReplaySHA256PCRs(events)
+		for idx, got := range replayed {
+			if quoted, ok := report.PCRsSHA256[idx]; ok && !bytes.Equal(got, quoted) {
+				return fmt.Errorf("event log replay for PCR %d (%x) does not match the quoted value (%x)", idx, got, quoted)
+			}
+		}
+		for _, want := range policy.EventLogEntries {
+			if !eventLogContains(events, want) {
+				return fmt.Errorf("event log is missing required entry %q", want)
+			}
+		}
+	}
+
+	if len(policy.IMAEntries) > 0 {
+		for _, want := range policy.IMAEntries {
+			if !bytes.Contains(report.IMALog, want) {
+				return fmt.Errorf("IMA log is missing required entry %q", want)
+			}
+		}
+	}
+
+	return nil
+}
+
+func eventLogContains(events []EventLogEvent, want []byte) bool {
+	for _, e := range events {
+		if bytes.Contains(e.Data, want) {
+			return true
+		}
+	}
+	return false
+}
+
+func sha256DigestPCRs(pcrs map[uint32][]byte) []byte {
+	h := sha256.New()
+	for i := uint32(0); i < 24; i++ {
+		if pcr, ok := pcrs[i]; ok {
+			h.Write(pcr)
+		}
+	}
+	return h.Sum(nil)
+}
+
+// parseTPMSAttestQuote parses a TPMS_ATTEST structure of type
+// TPM_ST_ATTEST_QUOTE, returning its extraData (the nonce the quote was
+// bound to) and its TPMS_QUOTE_INFO.pcrDigest.
+func parseTPMSAttestQuote(attest []byte) (extraData, pcrDigest []byte, err error) {
+	const stAttestQuote = 0x8018
+
+	r := bytes.NewReader(attest)
+	var magic uint32
+	if err := binary.Read(r, binary.BigEndian, &magic); err != nil {
+		return nil, nil, fmt.Errorf("reading magic: %v", err)
+	}
+	if magic != tpmGeneratedValue {
+		return nil, nil, fmt.Errorf("attest is not TPM generated (magic = %#x)", magic)
+	}
+	var typ uint16
+	if err := binary.Read(r, binary.BigEndian, &typ); err != nil {
+		return nil, nil, fmt.Errorf("reading type: %v", err)
+	}
+	if typ != stAttestQuote {
+		return nil, nil, fmt.Errorf("attest type %#x is not TPM_ST_ATTEST_QUOTE", typ)
+	}
+	if _, err := readTPM2B(r); err != nil { // qualifiedSigner
+		return nil, nil, fmt.Errorf("reading qualifiedSigner: %v", err)
+	}
+	if extraData, err = readTPM2B(r); err != nil {
+		return nil, nil, fmt.Errorf("reading extraData: %v", err)
+	}
+	if _, err := r.Seek(17+8, io.SeekCurrent); err != nil { // clockInfo + firmwareVersion
+		return nil, nil, fmt.Errorf("skipping clockInfo/firmwareVersion: %v", err)
+	}
+
+	// TPML_PCR_SELECTION: a count, followed by that many
+	// (hash alg uint16, sizeofSelect uint8, pcrSelect[sizeofSelect]) entries.
+	var count uint32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, nil, fmt.Errorf("reading pcrSelection count: %v", err)
+	}
+	for i := uint32(0); i < count; i++ {
+		if _, err := r.Seek(2, io.SeekCurrent); err != nil { // hash alg
+			return nil, nil, fmt.Errorf("skipping pcrSelection hash alg: %v", err)
+		}
+		var sizeofSelect uint8
+		if err := binary.Read(r, binary.BigEndian, &sizeofSelect); err != nil {
+			return nil, nil, fmt.Errorf("reading sizeofSelect: %v", err)
+		}
+		if _, err := r.Seek(int64(sizeofSelect), io.SeekCurrent); err != nil {
+			return nil, nil, fmt.Errorf("skipping pcrSelect: %v", err)
+		}
+	}
+
+	if pcrDigest, err = readTPM2B(r); err != nil {
+		return nil, nil, fmt.Errorf("reading pcrDigest: %v", err)
+	}
+	return extraData, pcrDigest, nil
+}
+
+// parseAIKPublicKey extracts the crypto.PublicKey from a marshaled
+// TPMT_PUBLIC AIK public area, the same representation quote20 signs
+// over and AzureAK.Public carries.
+func parseAIKPublicKey(aikPublicArea []byte) (crypto.PublicKey, error) {
+	pub, err := tpm2.DecodePublic(aikPublicArea)
+	if err != nil {
+		return nil, fmt.Errorf("decoding public area: %v", err)
+	}
+	return pub.Key()
+}
+
+// verifyQuoteSignature verifies rawSig -- a TPMT_SIGNATURE packed the
+// same way quote20 packs it -- over quote, using aikPub, which must be
+// an *rsa.PublicKey or *ecdsa.PublicKey.
+func verifyQuoteSignature(aikPub crypto.PublicKey, quote, rawSig []byte) error {
+	var alg tpm2.Algorithm
+	read, err := tpmutil.Unpack(rawSig, &alg)
+	if err != nil {
+		return fmt.Errorf("unpacking signature algorithm: %v", err)
+	}
+	rest := rawSig[read:]
+
+	switch alg {
+	case tpm2.AlgRSASSA:
+		rsaPub, ok := aikPub.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("quote was signed with an RSA key, but aik public key is %T", aikPub)
+		}
+		var hashAlg tpm2.Algorithm
+		var sig tpmutil.U16Bytes
+		if _, err := tpmutil.Unpack(rest, &hashAlg, &sig); err != nil {
+			return fmt.Errorf("unpacking RSA signature: %v", err)
+		}
+		h, err := tpm2HashAlgToCryptoHash(hashAlg)
+		if err != nil {
+			return err
+		}
+		digest := h.New()
+		digest.Write(quote)
+		return rsa.VerifyPKCS1v15(rsaPub, h, digest.Sum(nil), sig)
+
+	case tpm2.AlgECDSA:
+		ecdsaPub, ok := aikPub.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("quote was signed with an ECDSA key, but aik public key is %T", aikPub)
+		}
+		var hashAlg tpm2.Algorithm
+		var r, s tpmutil.U16Bytes
+		if _, err := tpmutil.Unpack(rest, &hashAlg, &r, &s); err != nil {
+			return fmt.Errorf("unpacking ECDSA signature: %v", err)
+		}
+		h, err := tpm2HashAlgToCryptoHash(hashAlg)
+		if err != nil {
+			return err
+		}
+		digest := h.New()
+		digest.Write(quote)
+		if !ecdsa.Verify(ecdsaPub, digest.Sum(nil), new(big.Int).SetBytes(r), new(big.Int).SetBytes(s)) {
+			return fmt.Errorf("ECDSA signature is not valid")
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported quote signature algorithm %#x", alg)
+	}
+}
+
+// tpm2HashAlgToCryptoHash maps a TPM_ALG_ID hash algorithm to the
+// equivalent crypto.Hash.
+func tpm2HashAlgToCryptoHash(alg tpm2.Algorithm) (crypto.Hash, error) {
+	switch alg {
+	case tpm2.AlgSHA1:
+		return crypto.SHA1, nil
+	case tpm2.AlgSHA256:
+		return crypto.SHA256, nil
+	case tpm2.AlgSHA384:
+		return crypto.SHA384, nil
+	default:
+		return 0, fmt.Errorf("unsupported hash algorithm %#x", alg)
+	}
+}
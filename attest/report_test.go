@@ -0,0 +1,223 @@
+// Copyright 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package attest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+func encodeTestEvent(pcr, typ uint32, digest [20]byte, data []byte) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, pcr)
+	binary.Write(&buf, binary.LittleEndian, typ)
+	buf.Write(digest[:])
+	binary.Write(&buf, binary.LittleEndian, uint32(len(data)))
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+func TestParseEventLogAndReplay(t *testing.T) {
+	data := []byte("secure-boot-enabled")
+	digest := sha1.Sum(data)
+
+	log := encodeTestEvent(7, 0x1, digest, data)
+	events, err := ParseEventLog(log)
+	if err != nil {
+		t.Fatalf("ParseEventLog() failed: %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+	if events[0].PCRIndex != 7 {
+		t.Errorf("PCRIndex = %d, want 7", events[0].PCRIndex)
+	}
+
+	pcrs := ReplaySHA1PCRs(events)
+	h := sha1.New()
+	h.Write(make([]byte, sha1.Size))
+	h.Write(digest[:])
+	want := h.Sum(nil)
+	if !bytes.Equal(pcrs[7], want) {
+		t.Errorf("replayed PCR 7 = %x, want %x", pcrs[7], want)
+	}
+
+	if !eventLogContains(events, []byte("secure-boot")) {
+		t.Errorf("eventLogContains() = false, want true")
+	}
+}
+
+func TestReplayIMALog(t *testing.T) {
+	templateHash := sha1.Sum([]byte("template"))
+	line := "10 " + hexEncode(templateHash[:]) + " ima-ng sha256:abcd /usr/bin/foo\n"
+
+	pcrs, err := ReplayIMALog([]byte(line))
+	if err != nil {
+		t.Fatalf("ReplayIMALog() failed: %v", err)
+	}
+	h := sha1.New()
+	h.Write(make([]byte, sha1.Size))
+	h.Write(templateHash[:])
+	want := h.Sum(nil)
+	if !bytes.Equal(pcrs[10], want) {
+		t.Errorf("replayed PCR 10 = %x, want %x", pcrs[10], want)
+	}
+}
+
+func TestVerifyQuoteSignature(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating aik key: %v", err)
+	}
+
+	quote := []byte("quote-bytes-to-sign")
+	digest := sha256.Sum256(quote)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("signing quote: %v", err)
+	}
+	rawSig, err := tpmutil.Pack(tpm2.AlgRSASSA, tpm2.AlgSHA256, tpmutil.U16Bytes(sig))
+	if err != nil {
+		t.Fatalf("packing signature: %v", err)
+	}
+
+	if err := verifyQuoteSignature(&key.PublicKey, quote, rawSig); err != nil {
+		t.Errorf("verifyQuoteSignature() failed for a validly-signed quote: %v", err)
+	}
+
+	tampered := append([]byte{}, quote...)
+	tampered[0] ^= 0xff
+	if err := verifyQuoteSignature(&key.PublicKey, tampered, rawSig); err == nil {
+		t.Errorf("verifyQuoteSignature() succeeded for a quote that was tampered with after signing, want error")
+	}
+
+	badSig := append([]byte{}, rawSig...)
+	badSig[len(badSig)-1] ^= 0xff
+	if err := verifyQuoteSignature(&key.PublicKey, quote, badSig); err == nil {
+		t.Errorf("verifyQuoteSignature() succeeded for a corrupted signature, want error")
+	}
+}
+
+// encodeTestQuoteAttest builds a minimal TPMS_ATTEST of type
+// TPM_ST_ATTEST_QUOTE, with an empty pcrSelection, for use by Verify
+// tests.
+func encodeTestQuoteAttest(extraData, pcrDigest []byte) []byte {
+	const stAttestQuote = 0x8018
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(tpmGeneratedValue))
+	binary.Write(&buf, binary.BigEndian, uint16(stAttestQuote))
+	putTPM2B(&buf, []byte("qualified-signer")) // qualifiedSigner
+	putTPM2B(&buf, extraData)
+	buf.Write(make([]byte, 17+8))                   // clockInfo + firmwareVersion
+	binary.Write(&buf, binary.BigEndian, uint32(0)) // pcrSelection count
+	putTPM2B(&buf, pcrDigest)
+	return buf.Bytes()
+}
+
+// buildTestReport builds an AttestationReport whose quote is validly
+// signed by aikKey over nonce, and whose PCRsSHA256 digests to the
+// quote's pcrDigest, for use by Verify tests.
+func buildTestReport(t *testing.T, aikKey *rsa.PrivateKey, nonce []byte, pcrs map[uint32][]byte) *AttestationReport {
+	t.Helper()
+
+	quote := encodeTestQuoteAttest(nonce, sha256DigestPCRs(pcrs))
+	digest := sha256.Sum256(quote)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, aikKey, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("signing quote: %v", err)
+	}
+	rawSig, err := tpmutil.Pack(tpm2.AlgRSASSA, tpm2.AlgSHA256, tpmutil.U16Bytes(sig))
+	if err != nil {
+		t.Fatalf("packing signature: %v", err)
+	}
+
+	return &AttestationReport{
+		Quote: &Quote{
+			Version:   TPMVersion20,
+			Quote:     quote,
+			Signature: rawSig,
+		},
+		PCRsSHA256: pcrs,
+	}
+}
+
+func TestVerify(t *testing.T) {
+	aikKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating aik key: %v", err)
+	}
+	aikPublicArea := encodeTestRSAPublicArea(t, &aikKey.PublicKey)
+
+	nonce := []byte("attestation-nonce")
+	pcrs := map[uint32][]byte{7: bytes.Repeat([]byte{0x42}, sha256.Size)}
+	report := buildTestReport(t, aikKey, nonce, pcrs)
+
+	policy := Policy{PCRs: map[uint32][]byte{7: pcrs[7]}}
+	if err := Verify(report, aikPublicArea, policy, nonce); err != nil {
+		t.Errorf("Verify() failed for a validly-signed report matching its policy: %v", err)
+	}
+}
+
+func TestVerifyPolicyMismatch(t *testing.T) {
+	aikKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating aik key: %v", err)
+	}
+	aikPublicArea := encodeTestRSAPublicArea(t, &aikKey.PublicKey)
+
+	nonce := []byte("attestation-nonce")
+	pcrs := map[uint32][]byte{7: bytes.Repeat([]byte{0x42}, sha256.Size)}
+	report := buildTestReport(t, aikKey, nonce, pcrs)
+
+	policy := Policy{PCRs: map[uint32][]byte{7: bytes.Repeat([]byte{0xff}, sha256.Size)}}
+	if err := Verify(report, aikPublicArea, policy, nonce); err == nil {
+		t.Errorf("Verify() succeeded for a report whose PCR 7 does not match the policy, want error")
+	}
+}
+
+func TestVerifyBadNonce(t *testing.T) {
+	aikKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating aik key: %v", err)
+	}
+	aikPublicArea := encodeTestRSAPublicArea(t, &aikKey.PublicKey)
+
+	nonce := []byte("attestation-nonce")
+	pcrs := map[uint32][]byte{7: bytes.Repeat([]byte{0x42}, sha256.Size)}
+	report := buildTestReport(t, aikKey, nonce, pcrs)
+
+	if err := Verify(report, aikPublicArea, Policy{}, []byte("different-nonce")); err == nil {
+		t.Errorf("Verify() succeeded with a nonce that does not match the quote, want error")
+	}
+}
+
+func hexEncode(b []byte) string {
+	const hextable = "0123456789abcdef"
+	out := make([]byte, len(b)*2)
+	for i, c := range b {
+		out[i*2] = hextable[c>>4]
+		out[i*2+1] = hextable[c&0x0f]
+	}
+	return string(out)
+}
@@ -0,0 +1,207 @@
+// Copyright 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package attest
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// SessionOptions configures a Session started with TPM.StartAuthSession.
+type SessionOptions struct {
+	// Encrypt starts the session with AES as its symmetric algorithm, so
+	// parameters of commands run under it can be AES-CFB encrypted under
+	// a key derived from the session, and makes decryptFirstParam decrypt
+	// rather than pass its input through. No command this package issues
+	// runs under a Session (see Session).
+	Encrypt bool
+	// Audit makes the session keep an audit digest, retrievable via
+	// Session.AuditDigest, into which recordAudit folds command/response
+	// pairs. No command path in this package calls recordAudit.
+	Audit bool
+	// EK selects the algorithm family of the EK the session is salted
+	// against. The zero value selects EKAlgorithmRSA.
+	EK EKConfig
+}
+
+// Session is a salted HMAC session against a TPM, salted so that only the
+// TPM holding the corresponding EK private key can derive the session
+// key. It defends against a malicious kernel or bus interposer observing
+// command and response parameters in the clear, which matters for
+// discrete TPMs on an external bus such as SPI or LPC.
+//
+// The high-level tpm2 command wrappers this package builds on (tpm2.Quote,
+// tpm2.NVReadEx, and so on) don't expose a way to run under an explicit
+// auth session, so a Session cannot yet be attached to any command this
+// package issues: it is a self-contained primitive (salting, key
+// derivation, parameter en/decryption, audit digest accumulation) for a
+// future session-aware command dispatch path, not something callers can
+// plug into quote20, readAllPCRs20, or readEKCertFromNVRAM20 today.
+//
+// A Session must be closed with Close once it is no longer needed.
+type Session struct {
+	tpm     io.ReadWriter
+	handle  tpmutil.Handle
+	opts    SessionOptions
+	sessKey []byte
+	audit   hash.Hash
+}
+
+// StartAuthSession starts a session salted against the TPM's EK (so only
+// the TPM that holds the EK's private key can derive the session key),
+// and bound to no particular object.
+func (t *TPM) StartAuthSession(opts SessionOptions) (*Session, error) {
+	return startAuthSession(t.tpm, opts)
+}
+
+func startAuthSession(rw io.ReadWriter, opts SessionOptions) (*Session, error) {
+	ekTemplate, err := opts.EK.Template()
+	if err != nil {
+		return nil, fmt.Errorf("selecting EK template: %v", err)
+	}
+	ekHandle, ekPub, err := tpm2.CreatePrimary(rw, tpm2.HandleEndorsement, tpm2.PCRSelection{}, "", "", ekTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("creating EK for session salt: %v", err)
+	}
+	defer tpm2.FlushContext(rw, ekHandle)
+
+	rsaEKPub, ok := ekPub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported EK public key type %T for session salting", ekPub)
+	}
+
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("generating session salt: %v", err)
+	}
+	encSalt, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaEKPub, salt, []byte("SECRET\x00"))
+	if err != nil {
+		return nil, fmt.Errorf("encrypting session salt to the EK: %v", err)
+	}
+
+	nonceCaller := make([]byte, 16)
+	if _, err := rand.Read(nonceCaller); err != nil {
+		return nil, fmt.Errorf("generating nonceCaller: %v", err)
+	}
+
+	sym := tpm2.AlgNull
+	if opts.Encrypt {
+		sym = tpm2.AlgAES
+	}
+	handle, nonceTPM, err := tpm2.StartAuthSession(
+		rw,
+		ekHandle,
+		tpm2.HandleNull,
+		nonceCaller,
+		encSalt,
+		tpm2.SessionHMAC,
+		sym,
+		tpm2.AlgSHA256,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("starting auth session: %v", err)
+	}
+
+	sessKey := kdfa(salt, "ATH", nonceTPM, nonceCaller, sha256.Size*8)
+
+	s := &Session{
+		tpm:     rw,
+		handle:  handle,
+		opts:    opts,
+		sessKey: sessKey,
+	}
+	if opts.Audit {
+		s.audit = sha256.New()
+	}
+	return s, nil
+}
+
+// Close releases the session's handle in the TPM.
+func (s *Session) Close() error {
+	return tpm2.FlushContext(s.tpm, s.handle)
+}
+
+// AuditDigest returns the running audit digest accumulated over every
+// command/response pair recorded with recordAudit, or nil if the session
+// was not started with SessionOptions.Audit.
+func (s *Session) AuditDigest() []byte {
+	if s.audit == nil {
+		return nil
+	}
+	return s.audit.Sum(nil)
+}
+
+// recordAudit folds a command/response pair's digests into the running
+// audit digest, as auditDigest' = H(auditDigest || cpHash || rpHash).
+func (s *Session) recordAudit(cpHash, rpHash []byte) {
+	if s.audit == nil {
+		return
+	}
+	prev := s.audit.Sum(nil)
+	s.audit.Reset()
+	s.audit.Write(prev)
+	s.audit.Write(cpHash)
+	s.audit.Write(rpHash)
+}
+
+// decryptFirstParam decrypts the first response parameter of a command
+// run under this session's parameter encryption, per the TPM 2.0 "CFB"
+// parameter encryption scheme: AES-128-CFB keyed by a KDFa-derived
+// symmetric key, with an IV derived from the session nonces.
+func (s *Session) decryptFirstParam(nonceTPM, nonceCaller, encrypted []byte) ([]byte, error) {
+	if !s.opts.Encrypt {
+		return encrypted, nil
+	}
+	key := kdfa(s.sessKey, "CFB", nonceTPM, nonceCaller, 128+128)
+	aesKey, iv := key[:16], key[16:32]
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, fmt.Errorf("constructing AES cipher for parameter decryption: %v", err)
+	}
+	out := make([]byte, len(encrypted))
+	cipher.NewCFBDecrypter(block, iv).XORKeyStream(out, encrypted)
+	return out, nil
+}
+
+// kdfa implements the TPM 2.0 KDFa key derivation function (Part 1,
+// section 11.4.10.2): repeated HMAC-SHA256 over a counter, a NUL-
+// terminated label, and two context values, concatenated until sizeBits
+// bits have been produced.
+func kdfa(key []byte, label string, contextU, contextV []byte, sizeBits int) []byte {
+	var out []byte
+	for counter := uint32(1); len(out)*8 < sizeBits; counter++ {
+		mac := hmac.New(sha256.New, key)
+		binary.Write(mac, binary.BigEndian, counter)
+		mac.Write([]byte(label))
+		mac.Write([]byte{0})
+		mac.Write(contextU)
+		mac.Write(contextV)
+		binary.Write(mac, binary.BigEndian, uint32(sizeBits))
+		out = append(out, mac.Sum(nil)...)
+	}
+	return out[:sizeBits/8]
+}
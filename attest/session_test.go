@@ -0,0 +1,66 @@
+// Copyright 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package attest
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+func TestKDFaLength(t *testing.T) {
+	key := []byte("session-key-material")
+	out := kdfa(key, "ATH", []byte("nonceTPM"), []byte("nonceCaller"), 256)
+	if len(out) != 32 {
+		t.Errorf("kdfa() returned %d bytes, want 32", len(out))
+	}
+}
+
+func TestKDFaDeterministic(t *testing.T) {
+	key := []byte("session-key-material")
+	a := kdfa(key, "CFB", []byte("u"), []byte("v"), 256)
+	b := kdfa(key, "CFB", []byte("u"), []byte("v"), 256)
+	if !bytes.Equal(a, b) {
+		t.Errorf("kdfa() is not deterministic for identical inputs")
+	}
+
+	c := kdfa(key, "ATH", []byte("u"), []byte("v"), 256)
+	if bytes.Equal(a, c) {
+		t.Errorf("kdfa() produced identical output for different labels")
+	}
+}
+
+func TestEKConfigTemplate(t *testing.T) {
+	tmpl, err := EKConfig{Algorithm: EKAlgorithmRSA}.Template()
+	if err != nil {
+		t.Fatalf("EKConfig{RSA}.Template() failed: %v", err)
+	}
+	if tmpl.Type != tpm2.AlgRSA {
+		t.Errorf("EKConfig{RSA}.Template() Type = %v, want tpm2.AlgRSA", tmpl.Type)
+	}
+
+	tmpl, err = EKConfig{Algorithm: EKAlgorithmECC}.Template()
+	if err != nil {
+		t.Fatalf("EKConfig{ECC}.Template() failed: %v", err)
+	}
+	if tmpl.Type != tpm2.AlgECC {
+		t.Errorf("EKConfig{ECC}.Template() Type = %v, want tpm2.AlgECC", tmpl.Type)
+	}
+
+	if _, err := (EKConfig{Algorithm: EKAlgorithm(99)}).Template(); err == nil {
+		t.Errorf("EKConfig{99}.Template() succeeded, want error for unsupported algorithm")
+	}
+}
@@ -16,6 +16,8 @@ package attest
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/base64"
@@ -96,8 +98,140 @@ var (
 			ModulusRaw: make([]byte, 256),
 		},
 	}
+
+	// ECC variants of the templates above, for TPMs/callers that prefer
+	// an ECDSA/ECDH key over RSA. The AIK and EK variants are selected by
+	// AIKConfig.Algorithm and EKConfig.Algorithm below; nothing in this
+	// package selects defaultSRKTemplateECC. intelEKURLECC and the
+	// EKCertResolver machinery in ekresolver.go also consume the ECC EK
+	// case.
+	aikTemplateECC = tpm2.Public{
+		Type:       tpm2.AlgECC,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagSignerDefault,
+		ECCParameters: &tpm2.ECCParams{
+			Sign: &tpm2.SigScheme{
+				Alg:  tpm2.AlgECDSA,
+				Hash: tpm2.AlgSHA256,
+			},
+			CurveID: tpm2.CurveNISTP256,
+		},
+	}
+	defaultSRKTemplateECC = tpm2.Public{
+		Type:       tpm2.AlgECC,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagStorageDefault | tpm2.FlagNoDA,
+		ECCParameters: &tpm2.ECCParams{
+			Symmetric: &tpm2.SymScheme{
+				Alg:     tpm2.AlgAES,
+				KeyBits: 128,
+				Mode:    tpm2.AlgCFB,
+			},
+			CurveID: tpm2.CurveNISTP256,
+			Point: tpm2.ECPoint{
+				XRaw: make([]byte, 32),
+				YRaw: make([]byte, 32),
+			},
+		},
+	}
+	// Default ECC EK template defined in the same profile as
+	// defaultEKTemplate, section B.4.2 ("High Range").
+	defaultEKTemplateECC = tpm2.Public{
+		Type:    tpm2.AlgECC,
+		NameAlg: tpm2.AlgSHA256,
+		Attributes: tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin |
+			tpm2.FlagAdminWithPolicy | tpm2.FlagRestricted | tpm2.FlagDecrypt,
+		AuthPolicy: []byte{
+			0x83, 0x71, 0x97, 0x67, 0x44, 0x84,
+			0xB3, 0xF8, 0x1A, 0x90, 0xCC, 0x8D,
+			0x46, 0xA5, 0xD7, 0x24, 0xFD, 0x52,
+			0xD7, 0x6E, 0x06, 0x52, 0x0B, 0x64,
+			0xF2, 0xA1, 0xDA, 0x1B, 0x33, 0x14,
+			0x69, 0xAA,
+		},
+		ECCParameters: &tpm2.ECCParams{
+			Symmetric: &tpm2.SymScheme{
+				Alg:     tpm2.AlgAES,
+				KeyBits: 128,
+				Mode:    tpm2.AlgCFB,
+			},
+			CurveID: tpm2.CurveNISTP256,
+			Point: tpm2.ECPoint{
+				XRaw: make([]byte, 32),
+				YRaw: make([]byte, 32),
+			},
+		},
+	}
+)
+
+// AIKAlgorithm selects the key family of an AIK.
+type AIKAlgorithm int
+
+const (
+	// AIKAlgorithmRSA selects an RSA 2048 signing key, the default.
+	AIKAlgorithmRSA AIKAlgorithm = iota
+	// AIKAlgorithmECC selects an ECDSA NIST P-256 signing key.
+	AIKAlgorithmECC
+)
+
+// AIKConfig selects the algorithm family of an AIK's signing key. This
+// package does not yet expose a TPM.NewAIK that accepts one -- AIKConfig
+// and its Template method are the selector a future NewAIK would call,
+// the same way ResolveEKCert (ekresolver.go) predates a TPM.EKs() to call
+// it from.
+type AIKConfig struct {
+	// Algorithm selects the AIK's key family. The zero value is
+	// AIKAlgorithmRSA.
+	Algorithm AIKAlgorithm
+}
+
+// Template returns the tpm2.Public AIK creation template cfg selects.
+func (cfg AIKConfig) Template() (tpm2.Public, error) {
+	switch cfg.Algorithm {
+	case AIKAlgorithmRSA:
+		return aikTemplate, nil
+	case AIKAlgorithmECC:
+		return aikTemplateECC, nil
+	default:
+		return tpm2.Public{}, fmt.Errorf("unsupported AIK algorithm %v", cfg.Algorithm)
+	}
+}
+
+// EKAlgorithm selects the key family of a TPM's Endorsement Key.
+type EKAlgorithm int
+
+const (
+	// EKAlgorithmRSA selects the RSA 2048 "High Range" EK template, the
+	// default.
+	EKAlgorithmRSA EKAlgorithm = iota
+	// EKAlgorithmECC selects the ECC NIST P-256 "High Range" EK template.
+	EKAlgorithmECC
 )
 
+// EKConfig selects the algorithm family of the EK this package creates,
+// such as the EK StartAuthSession creates to salt a session. Note that
+// only EKAlgorithmRSA is currently usable for session salting: salting
+// against an ECC EK requires an ECDH key exchange this package does not
+// yet implement, so startAuthSession's RSA-OAEP salt encryption fails
+// with a clear error if an ECC EK is selected for it.
+type EKConfig struct {
+	// Algorithm selects the EK's key family. The zero value is
+	// EKAlgorithmRSA.
+	Algorithm EKAlgorithm
+}
+
+// Template returns the tpm2.Public EK creation template cfg selects.
+func (cfg EKConfig) Template() (tpm2.Public, error) {
+	switch cfg.Algorithm {
+	case EKAlgorithmRSA:
+		return defaultEKTemplate, nil
+	case EKAlgorithmECC:
+		return defaultEKTemplateECC, nil
+	default:
+		return tpm2.Public{}, fmt.Errorf("unsupported EK algorithm %v", cfg.Algorithm)
+	}
+}
+
 type tpm20Info struct {
 	vendor       string
 	manufacturer TCGVendorID
@@ -201,6 +335,18 @@ func intelEKURL(ekPub *rsa.PublicKey) string {
 	return intelEKCertServiceURL + base64.URLEncoding.EncodeToString(pubHash.Sum(nil))
 }
 
+// intelEKURLECC is the ECC equivalent of intelEKURL: Intel's EK
+// certificate service keys ECC EKs by the hash of their uncompressed
+// point, rather than an RSA modulus and exponent.
+func intelEKURLECC(ekPub *ecdsa.PublicKey) string {
+	pubHash := sha256.New()
+	pubHash.Write(elliptic.Marshal(ekPub.Curve, ekPub.X, ekPub.Y))
+
+	return intelEKCertServiceURL + base64.URLEncoding.EncodeToString(pubHash.Sum(nil))
+}
+
+// readEKCertFromNVRAM20 reads the EK certificate from its standard NVRAM
+// index.
 func readEKCertFromNVRAM20(tpm io.ReadWriter) (*x509.Certificate, error) {
 	ekCert, err := tpm2.NVReadEx(tpm, nvramCertIndex, tpm2.HandleOwner, "", 0)
 	if err != nil {
@@ -209,6 +355,7 @@ func readEKCertFromNVRAM20(tpm io.ReadWriter) (*x509.Certificate, error) {
 	return ParseEKCertificate(ekCert)
 }
 
+// quote20 issues a TPM2_Quote over the given PCR bank.
 func quote20(tpm io.ReadWriter, aikHandle tpmutil.Handle, hashAlg tpm2.Algorithm, nonce []byte) (*Quote, error) {
 	sel := tpm2.PCRSelection{Hash: hashAlg}
 	numPCRs := 24
@@ -221,7 +368,13 @@ func quote20(tpm io.ReadWriter, aikHandle tpmutil.Handle, hashAlg tpm2.Algorithm
 		return nil, err
 	}
 
-	rawSig, err := tpmutil.Pack(sig.Alg, sig.RSA.HashAlg, sig.RSA.Signature)
+	var rawSig []byte
+	switch sig.Alg {
+	case tpm2.AlgECDSA:
+		rawSig, err = tpmutil.Pack(sig.Alg, sig.ECC.HashAlg, tpmutil.U16Bytes(sig.ECC.R.Bytes()), tpmutil.U16Bytes(sig.ECC.S.Bytes()))
+	default:
+		rawSig, err = tpmutil.Pack(sig.Alg, sig.RSA.HashAlg, sig.RSA.Signature)
+	}
 	return &Quote{
 		Version:   TPMVersion20,
 		Quote:     quote,
@@ -229,6 +382,7 @@ func quote20(tpm io.ReadWriter, aikHandle tpmutil.Handle, hashAlg tpm2.Algorithm
 	}, err
 }
 
+// readAllPCRs20 reads every PCR in the given bank.
 func readAllPCRs20(tpm io.ReadWriter, alg tpm2.Algorithm) (map[uint32][]byte, error) {
 	numPCRs := 24
 	out := map[uint32][]byte{}
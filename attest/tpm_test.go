@@ -0,0 +1,54 @@
+// Copyright 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package attest
+
+import (
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+func TestAIKConfigTemplate(t *testing.T) {
+	tmpl, err := AIKConfig{Algorithm: AIKAlgorithmRSA}.Template()
+	if err != nil {
+		t.Fatalf("AIKConfig{RSA}.Template() failed: %v", err)
+	}
+	if tmpl.Type != tpm2.AlgRSA {
+		t.Errorf("AIKConfig{RSA}.Template() Type = %v, want tpm2.AlgRSA", tmpl.Type)
+	}
+
+	tmpl, err = AIKConfig{Algorithm: AIKAlgorithmECC}.Template()
+	if err != nil {
+		t.Fatalf("AIKConfig{ECC}.Template() failed: %v", err)
+	}
+	if tmpl.Type != tpm2.AlgECC {
+		t.Errorf("AIKConfig{ECC}.Template() Type = %v, want tpm2.AlgECC", tmpl.Type)
+	}
+
+	if _, err := (AIKConfig{Algorithm: AIKAlgorithm(99)}).Template(); err == nil {
+		t.Errorf("AIKConfig{99}.Template() succeeded, want error for unsupported algorithm")
+	}
+}
+
+func TestAIKConfigZeroValueIsRSA(t *testing.T) {
+	var cfg AIKConfig
+	tmpl, err := cfg.Template()
+	if err != nil {
+		t.Fatalf("AIKConfig{}.Template() failed: %v", err)
+	}
+	if tmpl.Type != tpm2.AlgRSA {
+		t.Errorf("AIKConfig{}.Template() Type = %v, want tpm2.AlgRSA for the zero value", tmpl.Type)
+	}
+}
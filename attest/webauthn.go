@@ -0,0 +1,325 @@
+// Copyright 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package attest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/google/certificate-transparency-go/asn1"
+	"github.com/google/certificate-transparency-go/x509"
+	"github.com/google/certificate-transparency-go/x509/pkix"
+)
+
+// oidTCGKpEKCertificate is the TCG-defined extended key usage that must be
+// present on an EK certificate, and which WebAuthn "tpm" attestation AIK
+// certificates re-use to identify themselves as TPM-issued.
+var oidTCGKpEKCertificate = asn1.ObjectIdentifier{2, 23, 133, 8, 3}
+
+// oidTCGAtTPMManufacturer, oidTCGAtTPMModel, and oidTCGAtTPMVersion identify
+// the vendor attributes the TCG requires an AIK certificate's SAN directory
+// name to carry, in lieu of a populated Subject.
+var (
+	oidTCGAtTPMManufacturer = asn1.ObjectIdentifier{2, 23, 133, 2, 1}
+	oidTCGAtTPMModel        = asn1.ObjectIdentifier{2, 23, 133, 2, 2}
+	oidTCGAtTPMVersion      = asn1.ObjectIdentifier{2, 23, 133, 2, 3}
+)
+
+// WebAuthnTPMAttestationStatement holds the fields of a WebAuthn "tpm"
+// attestation statement (the CBOR-decoded attStmt). Decoding the
+// attestationObject's CBOR is left to the caller, since this package does
+// not otherwise depend on a CBOR library; this type only carries the
+// already-decoded byte strings through to the TPM-specific verification
+// below.
+type WebAuthnTPMAttestationStatement struct {
+	// Ver is the attStmt "ver" field, which must be "2.0".
+	Ver string
+	// Alg is the COSEAlgorithmIdentifier the signature in Sig was
+	// produced with.
+	Alg int64
+	// X5c is the attestation certificate chain, leaf first.
+	X5c [][]byte
+	// Sig is the signature over CertInfo, produced by the AIK named in
+	// X5c[0].
+	Sig []byte
+	// CertInfo is the TPMS_ATTEST structure returned by TPM2_Quote/
+	// TPM2_Certify, encoded per the TPM 2.0 structures spec.
+	CertInfo []byte
+	// PubArea is the TPMT_PUBLIC structure describing the AIK, encoded
+	// per the TPM 2.0 structures spec.
+	PubArea []byte
+}
+
+// VerifyWebAuthnTPMAttestation verifies a WebAuthn "tpm" attestation
+// statement, as described in the WebAuthn spec's "TPM Attestation
+// Statement Format" section. authenticatorData and clientDataHash are the
+// values the relying party computed over the registration response; they
+// are combined and hashed to confirm certInfo's extraData is bound to this
+// specific ceremony.
+//
+// On success, it returns the verified AIK certificate so the caller can
+// make its own trust decisions (e.g. matching it against a manufacturer
+// root, or simply recording it).
+func VerifyWebAuthnTPMAttestation(stmt WebAuthnTPMAttestationStatement, authenticatorData, clientDataHash []byte) (*x509.Certificate, error) {
+	if stmt.Ver != "2.0" {
+		return nil, fmt.Errorf("attest: unsupported tpm attestation version %q", stmt.Ver)
+	}
+	if len(stmt.X5c) == 0 {
+		return nil, fmt.Errorf("attest: tpm attestation statement has no x5c certificates")
+	}
+	if _, err := ParseAIKPublic(TPMVersion20, stmt.PubArea); err != nil {
+		return nil, fmt.Errorf("parsing pubArea: %v", err)
+	}
+
+	aik, err := x509.ParseCertificate(stmt.X5c[0])
+	if err != nil {
+		return nil, fmt.Errorf("parsing x5c[0]: %v", err)
+	}
+	if err := verifyWebAuthnAIKCert(aik); err != nil {
+		return nil, fmt.Errorf("verifying aik certificate: %v", err)
+	}
+
+	sigHash, err := coseSignatureHash(stmt.Alg)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyCertInfoSignature(aik, sigHash, stmt.CertInfo, stmt.Sig); err != nil {
+		return nil, fmt.Errorf("verifying certInfo signature: %v", err)
+	}
+
+	attestedName, extraData, err := parseTPMSAttestCertify(stmt.CertInfo)
+	if err != nil {
+		return nil, fmt.Errorf("parsing certInfo: %v", err)
+	}
+
+	wantExtraData := digestConcat(sigHash, authenticatorData, clientDataHash)
+	if !bytes.Equal(extraData, wantExtraData) {
+		return nil, fmt.Errorf("certInfo extraData does not match authenticatorData || clientDataHash")
+	}
+
+	wantName, err := pubAreaName(stmt.PubArea)
+	if err != nil {
+		return nil, fmt.Errorf("computing pubArea name: %v", err)
+	}
+	if !bytes.Equal(attestedName, wantName) {
+		return nil, fmt.Errorf("certInfo attested name does not match pubArea")
+	}
+
+	return aik, nil
+}
+
+// verifyWebAuthnAIKCert checks the properties the WebAuthn spec requires of
+// a TPM attestation certificate: an empty Subject, the TCG EK certificate
+// EKU, and a SAN directory name carrying the TPM manufacturer/model/
+// version.
+func verifyWebAuthnAIKCert(cert *x509.Certificate) error {
+	if cert.Subject.String() != "" {
+		return fmt.Errorf("certificate subject must be empty")
+	}
+
+	var hasEKU bool
+	for _, oid := range cert.UnknownExtKeyUsage {
+		if oid.Equal(oidTCGKpEKCertificate) {
+			hasEKU = true
+			break
+		}
+	}
+	if !hasEKU {
+		return fmt.Errorf("certificate is missing the TCG EK certificate EKU (%v)", oidTCGKpEKCertificate)
+	}
+
+	dirNames, err := parseSANDirectoryNames(cert)
+	if err != nil {
+		return fmt.Errorf("parsing subjectAltName: %v", err)
+	}
+	var haveManufacturer, haveModel, haveVersion bool
+	for _, attr := range dirNames {
+		switch {
+		case attr.Type.Equal(oidTCGAtTPMManufacturer):
+			haveManufacturer = true
+		case attr.Type.Equal(oidTCGAtTPMModel):
+			haveModel = true
+		case attr.Type.Equal(oidTCGAtTPMVersion):
+			haveVersion = true
+		}
+	}
+	if !haveManufacturer || !haveModel || !haveVersion {
+		return fmt.Errorf("subjectAltName directory name is missing tcg-at-tpmManufacturer/Model/Version")
+	}
+	return nil
+}
+
+// parseSANDirectoryNames extracts the RDN attributes of any directoryName
+// general names carried in cert's subjectAltName extension.
+func parseSANDirectoryNames(cert *x509.Certificate) ([]pkix.AttributeTypeAndValue, error) {
+	const oidExtensionSubjectAltName = 17
+	var ext []byte
+	for _, e := range cert.Extensions {
+		if len(e.Id) == 4 && e.Id[0] == 2 && e.Id[1] == 5 && e.Id[2] == 29 && e.Id[3] == oidExtensionSubjectAltName {
+			ext = e.Value
+			break
+		}
+	}
+	if ext == nil {
+		return nil, fmt.Errorf("certificate has no subjectAltName extension")
+	}
+
+	var seq asn1.RawValue
+	if _, err := asn1.Unmarshal(ext, &seq); err != nil {
+		return nil, err
+	}
+	rest := seq.Bytes
+	var attrs []pkix.AttributeTypeAndValue
+	for len(rest) > 0 {
+		var gn asn1.RawValue
+		var err error
+		rest, err = asn1.Unmarshal(rest, &gn)
+		if err != nil {
+			return nil, err
+		}
+		// directoryName is context tag [4], constructed.
+		if gn.Tag != 4 {
+			continue
+		}
+		var rdnSeq pkix.RDNSequence
+		if _, err := asn1.Unmarshal(gn.Bytes, &rdnSeq); err != nil {
+			return nil, err
+		}
+		for _, rdn := range rdnSeq {
+			attrs = append(attrs, rdn...)
+		}
+	}
+	return attrs, nil
+}
+
+func coseSignatureHash(alg int64) (crypto.Hash, error) {
+	switch alg {
+	case -257: // RS256
+		return crypto.SHA256, nil
+	case -258: // RS384
+		return crypto.SHA384, nil
+	default:
+		return 0, fmt.Errorf("unsupported COSEAlgorithmIdentifier %d", alg)
+	}
+}
+
+func digestConcat(h crypto.Hash, parts ...[]byte) []byte {
+	hh := h.New()
+	for _, p := range parts {
+		hh.Write(p)
+	}
+	return hh.Sum(nil)
+}
+
+// verifyCertInfoSignature checks sig over certInfo using the AIK
+// certificate's public key.
+func verifyCertInfoSignature(aik *x509.Certificate, h crypto.Hash, certInfo, sig []byte) error {
+	pub, ok := aik.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("unsupported aik public key type %T", aik.PublicKey)
+	}
+	return rsa.VerifyPKCS1v15(pub, h, digestConcat(h, certInfo), sig)
+}
+
+// tpmGeneratedValue and stAttestCertify are the values a TPMS_ATTEST's
+// magic and type fields must hold for a certInfo produced by
+// TPM2_Certify/TPM2_Quote, per the TPM 2.0 structures spec.
+const (
+	tpmGeneratedValue = 0xff544347
+	stAttestCertify   = 0x8017
+)
+
+// parseTPMSAttestCertify parses the subset of a TPMS_ATTEST structure that
+// WebAuthn "tpm" attestation relies on: the name of the attested object,
+// and the extraData the quote was bound to.
+func parseTPMSAttestCertify(certInfo []byte) (attestedName, extraData []byte, err error) {
+	buf := bytes.NewReader(certInfo)
+
+	var magic uint32
+	if err := binary.Read(buf, binary.BigEndian, &magic); err != nil {
+		return nil, nil, fmt.Errorf("reading magic: %v", err)
+	}
+	if magic != tpmGeneratedValue {
+		return nil, nil, fmt.Errorf("certInfo is not TPM generated (magic = %#x)", magic)
+	}
+
+	var typ uint16
+	if err := binary.Read(buf, binary.BigEndian, &typ); err != nil {
+		return nil, nil, fmt.Errorf("reading type: %v", err)
+	}
+	if typ != stAttestCertify {
+		return nil, nil, fmt.Errorf("certInfo type %#x is not TPM_ST_ATTEST_CERTIFY", typ)
+	}
+
+	if _, err := readTPM2B(buf); err != nil { // qualifiedSigner
+		return nil, nil, fmt.Errorf("reading qualifiedSigner: %v", err)
+	}
+	if extraData, err = readTPM2B(buf); err != nil {
+		return nil, nil, fmt.Errorf("reading extraData: %v", err)
+	}
+	// clockInfo (17 bytes) + firmwareVersion (8 bytes).
+	if _, err := buf.Seek(17+8, io.SeekCurrent); err != nil {
+		return nil, nil, fmt.Errorf("skipping clockInfo/firmwareVersion: %v", err)
+	}
+	if attestedName, err = readTPM2B(buf); err != nil { // attested.name
+		return nil, nil, fmt.Errorf("reading attested name: %v", err)
+	}
+
+	return attestedName, extraData, nil
+}
+
+// readTPM2B reads a TPM2B-style length-prefixed byte string: a big-endian
+// uint16 size followed by that many bytes.
+func readTPM2B(r *bytes.Reader) ([]byte, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// pubAreaName computes the TPM "name" of a public area: its nameAlg
+// (TPMT_PUBLIC's second field) followed by the digest of the raw pubArea
+// bytes under that algorithm.
+func pubAreaName(pubArea []byte) ([]byte, error) {
+	if len(pubArea) < 4 {
+		return nil, fmt.Errorf("pubArea too short to contain a nameAlg")
+	}
+	nameAlg := binary.BigEndian.Uint16(pubArea[2:4])
+
+	var h crypto.Hash
+	switch nameAlg {
+	case 0x000b: // TPM_ALG_SHA256
+		h = crypto.SHA256
+	case 0x000c: // TPM_ALG_SHA384
+		h = crypto.SHA384
+	case 0x0004: // TPM_ALG_SHA1
+		h = crypto.SHA1
+	default:
+		return nil, fmt.Errorf("unsupported nameAlg %#x", nameAlg)
+	}
+
+	name := make([]byte, 2, 2+h.Size())
+	binary.BigEndian.PutUint16(name, nameAlg)
+	return append(name, digestConcat(h, pubArea)...), nil
+}
@@ -0,0 +1,278 @@
+// Copyright 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package attest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/google/certificate-transparency-go/asn1"
+	"github.com/google/certificate-transparency-go/x509"
+	"github.com/google/certificate-transparency-go/x509/pkix"
+)
+
+// issueTestWebAuthnAIKCert builds a self-signed AIK certificate satisfying
+// the properties verifyWebAuthnAIKCert requires: an empty Subject, the TCG
+// EK certificate EKU, and a SAN directory name carrying the TPM
+// manufacturer/model/version attributes.
+func issueTestWebAuthnAIKCert(t *testing.T, aikKey *rsa.PrivateKey) []byte {
+	t.Helper()
+
+	rdn := pkix.RDNSequence{
+		pkix.RelativeDistinguishedNameSET{
+			pkix.AttributeTypeAndValue{Type: oidTCGAtTPMManufacturer, Value: "id:00001014"},
+			pkix.AttributeTypeAndValue{Type: oidTCGAtTPMModel, Value: "vTPM"},
+			pkix.AttributeTypeAndValue{Type: oidTCGAtTPMVersion, Value: "id:00010001"},
+		},
+	}
+	rdnBytes, err := asn1.Marshal(rdn)
+	if err != nil {
+		t.Fatalf("marshaling RDNSequence: %v", err)
+	}
+	dirName := asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 4, IsCompound: true, Bytes: rdnBytes}
+	dirNameBytes, err := asn1.Marshal(dirName)
+	if err != nil {
+		t.Fatalf("marshaling directoryName: %v", err)
+	}
+	san, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, Class: asn1.ClassUniversal, IsCompound: true, Bytes: dirNameBytes})
+	if err != nil {
+		t.Fatalf("marshaling subjectAltName: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:       big.NewInt(1),
+		NotBefore:          time.Now().Add(-time.Hour),
+		NotAfter:           time.Now().Add(time.Hour),
+		UnknownExtKeyUsage: []asn1.ObjectIdentifier{oidTCGKpEKCertificate},
+		ExtraExtensions: []pkix.Extension{
+			{Id: asn1.ObjectIdentifier{2, 5, 29, 17}, Value: san},
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &aikKey.PublicKey, aikKey)
+	if err != nil {
+		t.Fatalf("creating test aik certificate: %v", err)
+	}
+	return der
+}
+
+// buildTestWebAuthnTPMAttestation assembles a full, internally-consistent
+// WebAuthnTPMAttestationStatement: an AIK certificate, a pubArea for the
+// same key, a certInfo bound to authenticatorData/clientDataHash, and a
+// signature over that certInfo from the AIK.
+func buildTestWebAuthnTPMAttestation(t *testing.T, authenticatorData, clientDataHash []byte) WebAuthnTPMAttestationStatement {
+	t.Helper()
+
+	aikKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating aik key: %v", err)
+	}
+	pubArea := encodeTestRSAPublicArea(t, &aikKey.PublicKey)
+
+	wantName, err := pubAreaName(pubArea)
+	if err != nil {
+		t.Fatalf("pubAreaName() failed: %v", err)
+	}
+	extraData := digestConcat(crypto.SHA256, authenticatorData, clientDataHash)
+	certInfo := encodeTestCertInfo(extraData, wantName)
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, aikKey, crypto.SHA256, digestConcat(crypto.SHA256, certInfo))
+	if err != nil {
+		t.Fatalf("signing certInfo: %v", err)
+	}
+
+	return WebAuthnTPMAttestationStatement{
+		Ver:      "2.0",
+		Alg:      -257, // RS256
+		X5c:      [][]byte{issueTestWebAuthnAIKCert(t, aikKey)},
+		Sig:      sig,
+		CertInfo: certInfo,
+		PubArea:  pubArea,
+	}
+}
+
+func TestVerifyWebAuthnTPMAttestation(t *testing.T) {
+	authenticatorData := []byte("authenticator-data")
+	clientDataHash := []byte("client-data-hash")
+	stmt := buildTestWebAuthnTPMAttestation(t, authenticatorData, clientDataHash)
+
+	cert, err := VerifyWebAuthnTPMAttestation(stmt, authenticatorData, clientDataHash)
+	if err != nil {
+		t.Fatalf("VerifyWebAuthnTPMAttestation() failed: %v", err)
+	}
+	if cert.Subject.String() != "" {
+		t.Errorf("verified certificate has non-empty subject %q", cert.Subject)
+	}
+}
+
+func TestVerifyWebAuthnTPMAttestationBadSignature(t *testing.T) {
+	authenticatorData := []byte("authenticator-data")
+	clientDataHash := []byte("client-data-hash")
+	stmt := buildTestWebAuthnTPMAttestation(t, authenticatorData, clientDataHash)
+	stmt.Sig[0] ^= 0xff // corrupt the signature
+
+	if _, err := VerifyWebAuthnTPMAttestation(stmt, authenticatorData, clientDataHash); err == nil {
+		t.Errorf("VerifyWebAuthnTPMAttestation() succeeded with a corrupted signature, want error")
+	}
+}
+
+func TestVerifyWebAuthnTPMAttestationExtraDataMismatch(t *testing.T) {
+	authenticatorData := []byte("authenticator-data")
+	clientDataHash := []byte("client-data-hash")
+	stmt := buildTestWebAuthnTPMAttestation(t, authenticatorData, clientDataHash)
+
+	if _, err := VerifyWebAuthnTPMAttestation(stmt, authenticatorData, []byte("different-client-data-hash")); err == nil {
+		t.Errorf("VerifyWebAuthnTPMAttestation() succeeded with mismatched clientDataHash, want error")
+	}
+}
+
+func TestVerifyWebAuthnTPMAttestationNameMismatch(t *testing.T) {
+	authenticatorData := []byte("authenticator-data")
+	clientDataHash := []byte("client-data-hash")
+	stmt := buildTestWebAuthnTPMAttestation(t, authenticatorData, clientDataHash)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating mismatched key: %v", err)
+	}
+	stmt.PubArea = encodeTestRSAPublicArea(t, &otherKey.PublicKey) // no longer names the attested key in certInfo
+
+	if _, err := VerifyWebAuthnTPMAttestation(stmt, authenticatorData, clientDataHash); err == nil {
+		t.Errorf("VerifyWebAuthnTPMAttestation() succeeded with a pubArea that doesn't match certInfo's attested name, want error")
+	}
+}
+
+// putTPM2B appends a TPM2B-style length-prefixed byte string to buf.
+func putTPM2B(buf *bytes.Buffer, b []byte) {
+	binary.Write(buf, binary.BigEndian, uint16(len(b)))
+	buf.Write(b)
+}
+
+// encodeTestCertInfo builds a minimal TPMS_ATTEST of type
+// TPM_ST_ATTEST_CERTIFY, with the given extraData and attested name, for
+// use by parseTPMSAttestCertify tests.
+func encodeTestCertInfo(extraData, attestedName []byte) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(tpmGeneratedValue))
+	binary.Write(&buf, binary.BigEndian, uint16(stAttestCertify))
+	putTPM2B(&buf, []byte("qualified-signer")) // qualifiedSigner
+	putTPM2B(&buf, extraData)
+	buf.Write(make([]byte, 17+8)) // clockInfo + firmwareVersion
+	putTPM2B(&buf, attestedName)
+	return buf.Bytes()
+}
+
+func TestParseTPMSAttestCertify(t *testing.T) {
+	extraData := []byte("extra-data")
+	name := []byte("attested-name")
+	certInfo := encodeTestCertInfo(extraData, name)
+
+	gotName, gotExtraData, err := parseTPMSAttestCertify(certInfo)
+	if err != nil {
+		t.Fatalf("parseTPMSAttestCertify() failed: %v", err)
+	}
+	if !bytes.Equal(gotExtraData, extraData) {
+		t.Errorf("extraData = %x, want %x", gotExtraData, extraData)
+	}
+	if !bytes.Equal(gotName, name) {
+		t.Errorf("attestedName = %x, want %x", gotName, name)
+	}
+}
+
+func TestParseTPMSAttestCertifyBadMagic(t *testing.T) {
+	certInfo := encodeTestCertInfo([]byte("extra"), []byte("name"))
+	certInfo[0] ^= 0xff // corrupt the magic
+
+	if _, _, err := parseTPMSAttestCertify(certInfo); err == nil {
+		t.Errorf("parseTPMSAttestCertify() succeeded on a non-TPM-generated blob, want error")
+	}
+}
+
+func TestPubAreaName(t *testing.T) {
+	pubArea := append([]byte{0x00, 0x01, 0x00, 0x0b}, []byte("rest-of-pubarea")...)
+
+	name, err := pubAreaName(pubArea)
+	if err != nil {
+		t.Fatalf("pubAreaName() failed: %v", err)
+	}
+
+	h := sha256.New()
+	h.Write(pubArea)
+	want := append([]byte{0x00, 0x0b}, h.Sum(nil)...)
+	if !bytes.Equal(name, want) {
+		t.Errorf("pubAreaName() = %x, want %x", name, want)
+	}
+}
+
+func TestPubAreaNameUnsupportedAlg(t *testing.T) {
+	pubArea := []byte{0x00, 0x01, 0xff, 0xff}
+	if _, err := pubAreaName(pubArea); err == nil {
+		t.Errorf("pubAreaName() succeeded for an unsupported nameAlg, want error")
+	}
+}
+
+func TestParseSANDirectoryNames(t *testing.T) {
+	rdn := pkix.RDNSequence{
+		pkix.RelativeDistinguishedNameSET{
+			pkix.AttributeTypeAndValue{Type: oidTCGAtTPMManufacturer, Value: "id:00001014"},
+			pkix.AttributeTypeAndValue{Type: oidTCGAtTPMModel, Value: "vTPM"},
+			pkix.AttributeTypeAndValue{Type: oidTCGAtTPMVersion, Value: "id:00010001"},
+		},
+	}
+	rdnBytes, err := asn1.Marshal(rdn)
+	if err != nil {
+		t.Fatalf("marshaling RDNSequence: %v", err)
+	}
+	dirName := asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 4, IsCompound: true, Bytes: rdnBytes}
+	dirNameBytes, err := asn1.Marshal(dirName)
+	if err != nil {
+		t.Fatalf("marshaling directoryName: %v", err)
+	}
+	san, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, Class: asn1.ClassUniversal, IsCompound: true, Bytes: dirNameBytes})
+	if err != nil {
+		t.Fatalf("marshaling subjectAltName: %v", err)
+	}
+
+	cert := &x509.Certificate{
+		Extensions: []pkix.Extension{
+			{Id: asn1.ObjectIdentifier{2, 5, 29, 17}, Value: san},
+		},
+	}
+	attrs, err := parseSANDirectoryNames(cert)
+	if err != nil {
+		t.Fatalf("parseSANDirectoryNames() failed: %v", err)
+	}
+
+	var haveManufacturer, haveModel, haveVersion bool
+	for _, attr := range attrs {
+		switch {
+		case attr.Type.Equal(oidTCGAtTPMManufacturer):
+			haveManufacturer = true
+		case attr.Type.Equal(oidTCGAtTPMModel):
+			haveModel = true
+		case attr.Type.Equal(oidTCGAtTPMVersion):
+			haveVersion = true
+		}
+	}
+	if !haveManufacturer || !haveModel || !haveVersion {
+		t.Errorf("parseSANDirectoryNames() = %+v, missing one of tpmManufacturer/Model/Version", attrs)
+	}
+}